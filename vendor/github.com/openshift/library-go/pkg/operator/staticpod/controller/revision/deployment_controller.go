@@ -1,35 +1,48 @@
 package revision
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"time"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/golang/glog"
+	"k8s.io/klog/v2"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
 
 	operatorv1 "github.com/openshift/api/operator/v1"
 
 	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/factory"
 	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
-	"github.com/openshift/library-go/pkg/operator/staticpod/controller/common"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
 )
 
 const operatorStatusRevisionControllerFailing = "RevisionControllerFailing"
-const revisionControllerWorkQueueKey = "key"
+
+// revisionContentHashAnnotation records the content fingerprint of a revisioned configmap/secret so
+// isLatestRevisionCurrent can compare strings instead of deep-comparing the full Data payload on every sync.
+const revisionContentHashAnnotation = "operator.openshift.io/revision-content-hash"
+
+// maxConcurrentRevisionSyncs bounds how many configmaps/secrets are copied in
+// parallel while materializing a new revision.
+const maxConcurrentRevisionSyncs = 10
 
 // RevisionController is a controller that watches a set of configmaps and secrets and them against a revision snapshot
 // of them. If the original resources changes, the revision counter is increased, stored in LatestAvailableRevision
-// field of the operator config and new snapshots suffixed by the revision are created.
+// field of the operator config and new snapshots suffixed by the revision are created. Per-resource copies for a
+// given revision are created concurrently; if any of them fails, everything already created for that revision is
+// torn down so a half-materialized snapshot is never left behind.
 type RevisionController struct {
 	targetNamespace string
 	// configMaps is the list of configmaps that are directly copied.A different actor/controller modifies these.
@@ -38,52 +51,96 @@ type RevisionController struct {
 	// secrets is a list of secrets that are directly copied for the current values.  A different actor/controller modifies these.
 	secrets []string
 
-	operatorConfigClient common.OperatorClient
+	operatorClient v1helpers.OperatorClient
 
 	kubeClient kubernetes.Interface
 
-	// queue only ever has one item, but it has nice error handling backoff/retry semantics
-	queue workqueue.RateLimitingInterface
-
 	eventRecorder events.Recorder
+
+	// preconditions are evaluated, in order, before a revision bump is acted
+	// on. The first one to veto (proceed=false) or error stops evaluation.
+	preconditions []RevisionPrecondition
+
+	// revisionHistoryLimit bounds how many old revisions are kept around. Revisions older than
+	// LatestAvailableRevision-revisionHistoryLimit are pruned, unless still referenced by a node's
+	// CurrentRevision or TargetRevision. Zero (the default) disables pruning.
+	revisionHistoryLimit int32
+}
+
+// RevisionPrecondition gates whether a pending revision bump should actually
+// be rolled out. It receives the sync context and the current, live
+// configmaps/secrets that triggered the bump, and returns proceed=false with
+// a reason to defer the rollout, e.g. "don't roll a new revision while a node
+// is still draining". Implementations that block should respect ctx
+// cancellation/deadlines.
+type RevisionPrecondition func(ctx context.Context, configMaps []*corev1.ConfigMap, secrets []*corev1.Secret) (proceed bool, reason string, err error)
+
+// RevisionControllerOption mutates a RevisionController at construction time.
+type RevisionControllerOption func(*RevisionController)
+
+// WithPreconditions registers preconditions that must all pass before a new
+// revision is rolled out. Preconditions run in the order given.
+func WithPreconditions(preconditions ...RevisionPrecondition) RevisionControllerOption {
+	return func(c *RevisionController) {
+		c.preconditions = append(c.preconditions, preconditions...)
+	}
+}
+
+// WithRevisionHistoryLimit bounds how many old revisions are retained; see the field doc on RevisionController.
+func WithRevisionHistoryLimit(limit int32) RevisionControllerOption {
+	return func(c *RevisionController) {
+		c.revisionHistoryLimit = limit
+	}
 }
 
-// NewRevisionController create a new revision controller.
+// NewRevisionController creates a new revision controller, wired up as a library-go factory.Controller so it gets
+// leader-election-aware lifecycle, structured events and metrics for free.
+//
+// BREAKING: this constructor's return type changed from *RevisionController to factory.Controller and its client
+// param from common.OperatorClient to v1helpers.OperatorClient; the old Run/runWorker/processNextWorkItem surface
+// is gone. This must land together with a go.mod/go.sum/vendor/modules.txt bump of this dependency (not a hand
+// edit of the vendored copy) and an update of every pkg/operator call site that constructs this controller and
+// calls .Run(stopCh, workers) on it, or the real build will not compile.
 func NewRevisionController(
 	targetNamespace string,
 	configMaps []string,
 	secrets []string,
 	kubeInformersForTargetNamespace informers.SharedInformerFactory,
-	operatorConfigClient common.OperatorClient,
+	operatorClient v1helpers.OperatorClient,
 	kubeClient kubernetes.Interface,
 	eventRecorder events.Recorder,
-) *RevisionController {
+	options ...RevisionControllerOption,
+) factory.Controller {
 	c := &RevisionController{
 		targetNamespace: targetNamespace,
 		configMaps:      configMaps,
 		secrets:         secrets,
 
-		operatorConfigClient: operatorConfigClient,
-		kubeClient:           kubeClient,
-		eventRecorder:        eventRecorder,
-
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "RevisionController"),
+		operatorClient: operatorClient,
+		kubeClient:     kubeClient,
+		eventRecorder:  eventRecorder,
+	}
+	for _, option := range options {
+		option(c)
 	}
 
-	operatorConfigClient.Informer().AddEventHandler(c.eventHandler())
-	kubeInformersForTargetNamespace.Core().V1().ConfigMaps().Informer().AddEventHandler(c.eventHandler())
-	kubeInformersForTargetNamespace.Core().V1().Secrets().Informer().AddEventHandler(c.eventHandler())
-
-	return c
+	return factory.New().
+		WithInformers(
+			operatorClient.Informer(),
+			kubeInformersForTargetNamespace.Core().V1().ConfigMaps().Informer(),
+			kubeInformersForTargetNamespace.Core().V1().Secrets().Informer(),
+		).
+		WithSync(c.sync).
+		ToController("RevisionController", eventRecorder)
 }
 
 // createRevisionIfNeeded takes care of creating content for the static pods to use.
 // returns whether or not requeue and if an error happened when updating status.  Normally it updates status itself.
-func (c RevisionController) createRevisionIfNeeded(operatorSpec *operatorv1.OperatorSpec, operatorStatusOriginal *operatorv1.StaticPodOperatorStatus, resourceVersion string) (bool, error) {
+func (c RevisionController) createRevisionIfNeeded(ctx context.Context, operatorSpec *operatorv1.OperatorSpec, operatorStatusOriginal *operatorv1.StaticPodOperatorStatus, resourceVersion string) (bool, error) {
 	operatorStatus := operatorStatusOriginal.DeepCopy()
 
 	latestRevision := operatorStatus.LatestAvailableRevision
-	isLatestRevisionCurrent, reason := c.isLatestRevisionCurrent(latestRevision)
+	isLatestRevisionCurrent, reason := c.isLatestRevisionCurrent(ctx, latestRevision)
 
 	// check to make sure that the latestRevision has the exact content we expect.  No mutation here, so we start creating the next Revision only when it is required
 	if isLatestRevisionCurrent {
@@ -91,15 +148,34 @@ func (c RevisionController) createRevisionIfNeeded(operatorSpec *operatorv1.Oper
 	}
 
 	nextRevision := latestRevision + 1
-	glog.Infof("new revision %d triggered by %q", nextRevision, reason)
-	if err := c.createNewRevision(nextRevision); err != nil {
+
+	proceed, deferReason, err := c.runPreconditions(ctx)
+	if err != nil {
+		return true, err
+	}
+	if !proceed {
+		c.eventRecorder.Eventf("RevisionTriggerDeferred", "Deferred revision %d: %s", nextRevision, deferReason)
+		cond := operatorv1.OperatorCondition{
+			Type:    "RevisionControllerProgressing",
+			Status:  operatorv1.ConditionFalse,
+			Reason:  "Deferred",
+			Message: deferReason,
+		}
+		if _, _, updateError := v1helpers.UpdateStatus(c.operatorClient, v1helpers.UpdateConditionFn(cond)); updateError != nil {
+			return true, updateError
+		}
+		return true, nil
+	}
+
+	klog.Infof("new revision %d triggered by %q", nextRevision, reason)
+	if err := c.createNewRevision(ctx, nextRevision); err != nil {
 		cond := operatorv1.OperatorCondition{
 			Type:    "RevisionControllerFailing",
 			Status:  operatorv1.ConditionTrue,
 			Reason:  "ContentCreationError",
 			Message: err.Error(),
 		}
-		if _, _, updateError := common.UpdateStatus(c.operatorConfigClient, common.UpdateConditionFn(cond)); updateError != nil {
+		if _, _, updateError := v1helpers.UpdateStatus(c.operatorClient, v1helpers.UpdateConditionFn(cond)); updateError != nil {
 			c.eventRecorder.Warningf("RevisionCreateFailed", "Failed to create revision %d: %v", nextRevision, err.Error())
 			return true, updateError
 		}
@@ -110,7 +186,7 @@ func (c RevisionController) createRevisionIfNeeded(operatorSpec *operatorv1.Oper
 		Type:   "RevisionControllerFailing",
 		Status: operatorv1.ConditionFalse,
 	}
-	if _, updated, updateError := common.UpdateStatus(c.operatorConfigClient, common.UpdateConditionFn(cond), func(operatorStatus *operatorv1.StaticPodOperatorStatus) error {
+	if _, updated, updateError := v1helpers.UpdateStatus(c.operatorClient, v1helpers.UpdateConditionFn(cond), func(operatorStatus *operatorv1.StaticPodOperatorStatus) error {
 		operatorStatus.LatestAvailableRevision = nextRevision
 		return nil
 	}); updateError != nil {
@@ -127,30 +203,30 @@ func nameFor(name string, revision int32) string {
 }
 
 // isLatestRevisionCurrent returns whether the latest revision is up to date and an optional reason
-func (c RevisionController) isLatestRevisionCurrent(revision int32) (bool, string) {
+func (c RevisionController) isLatestRevisionCurrent(ctx context.Context, revision int32) (bool, string) {
 	for _, name := range c.configMaps {
-		required, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Get(name, metav1.GetOptions{})
+		required, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Get(ctx, name, metav1.GetOptions{})
 		if apierrors.IsNotFound(err) {
 			return false, err.Error()
 		}
-		existing, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Get(nameFor(name, revision), metav1.GetOptions{})
+		existing, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Get(ctx, nameFor(name, revision), metav1.GetOptions{})
 		if apierrors.IsNotFound(err) {
 			return false, err.Error()
 		}
-		if !equality.Semantic.DeepEqual(existing.Data, required.Data) {
+		if !c.configMapContentUnchanged(ctx, existing, required) {
 			return false, fmt.Sprintf("configmap/%s has changed", required.Name)
 		}
 	}
 	for _, name := range c.secrets {
-		required, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Get(name, metav1.GetOptions{})
+		required, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Get(ctx, name, metav1.GetOptions{})
 		if apierrors.IsNotFound(err) {
 			return false, err.Error()
 		}
-		existing, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Get(nameFor(name, revision), metav1.GetOptions{})
+		existing, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Get(ctx, nameFor(name, revision), metav1.GetOptions{})
 		if apierrors.IsNotFound(err) {
 			return false, err.Error()
 		}
-		if !equality.Semantic.DeepEqual(existing.Data, required.Data) {
+		if !c.secretContentUnchanged(ctx, existing, required) {
 			return false, fmt.Sprintf("secret/%s has changed", required.Name)
 		}
 	}
@@ -158,7 +234,116 @@ func (c RevisionController) isLatestRevisionCurrent(revision int32) (bool, strin
 	return true, ""
 }
 
-func (c RevisionController) createNewRevision(revision int32) error {
+// configMapContentUnchanged compares required's content against existing's recorded content-hash annotation,
+// short-circuiting the O(bytes) DeepEqual on every sync. If existing predates the annotation, it falls back to a
+// full DeepEqual once and backfills the annotation so later syncs take the cheap path.
+func (c RevisionController) configMapContentUnchanged(ctx context.Context, existing, required *corev1.ConfigMap) bool {
+	requiredHash, err := contentHash(required.Data)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to compute content hash for configmap/%s: %v", required.Name, err))
+		return equality.Semantic.DeepEqual(existing.Data, required.Data)
+	}
+
+	existingHash, ok := existing.Annotations[revisionContentHashAnnotation]
+	if !ok {
+		unchanged := equality.Semantic.DeepEqual(existing.Data, required.Data)
+		if unchanged {
+			c.backfillConfigMapContentHash(ctx, existing, requiredHash)
+		}
+		return unchanged
+	}
+
+	return existingHash == requiredHash
+}
+
+func (c RevisionController) backfillConfigMapContentHash(ctx context.Context, existing *corev1.ConfigMap, hash string) {
+	updated := existing.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[revisionContentHashAnnotation] = hash
+	if _, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to backfill content-hash annotation on configmap/%s: %v", existing.Name, err))
+	}
+}
+
+// secretContentUnchanged is the secret analog of configMapContentUnchanged.
+func (c RevisionController) secretContentUnchanged(ctx context.Context, existing, required *corev1.Secret) bool {
+	requiredHash, err := contentHash(required.Data)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to compute content hash for secret/%s: %v", required.Name, err))
+		return equality.Semantic.DeepEqual(existing.Data, required.Data)
+	}
+
+	existingHash, ok := existing.Annotations[revisionContentHashAnnotation]
+	if !ok {
+		unchanged := equality.Semantic.DeepEqual(existing.Data, required.Data)
+		if unchanged {
+			c.backfillSecretContentHash(ctx, existing, requiredHash)
+		}
+		return unchanged
+	}
+
+	return existingHash == requiredHash
+}
+
+func (c RevisionController) backfillSecretContentHash(ctx context.Context, existing *corev1.Secret, hash string) {
+	updated := existing.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[revisionContentHashAnnotation] = hash
+	if _, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to backfill content-hash annotation on secret/%s: %v", existing.Name, err))
+	}
+}
+
+// contentHash computes a stable fingerprint over canonical-JSON-encoded data (encoding/json sorts map keys), used
+// to stamp the revision-content-hash annotation on revisioned copies.
+func contentHash(data interface{}) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// runPreconditions fetches the live configmaps/secrets tracked by this
+// controller and runs them through the registered preconditions in order,
+// stopping at the first one that vetoes the rollout or errors.
+func (c RevisionController) runPreconditions(ctx context.Context) (bool, string, error) {
+	if len(c.preconditions) == 0 {
+		return true, "", nil
+	}
+
+	configMaps := make([]*corev1.ConfigMap, 0, len(c.configMaps))
+	for _, name := range c.configMaps {
+		configMap, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		configMaps = append(configMaps, configMap)
+	}
+	secrets := make([]*corev1.Secret, 0, len(c.secrets))
+	for _, name := range c.secrets {
+		secret, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		secrets = append(secrets, secret)
+	}
+
+	for _, precondition := range c.preconditions {
+		proceed, reason, err := precondition(ctx, configMaps, secrets)
+		if err != nil || !proceed {
+			return proceed, reason, err
+		}
+	}
+	return true, "", nil
+}
+
+func (c RevisionController) createNewRevision(ctx context.Context, revision int32) error {
 	statusConfigMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: c.targetNamespace,
@@ -169,7 +354,7 @@ func (c RevisionController) createNewRevision(revision int32) error {
 			"revision": fmt.Sprintf("%d", revision),
 		},
 	}
-	statusConfigMap, _, err := resourceapply.ApplyConfigMap(c.kubeClient.CoreV1(), c.eventRecorder, statusConfigMap)
+	statusConfigMap, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, statusConfigMap)
 	if err != nil {
 		return err
 	}
@@ -180,30 +365,207 @@ func (c RevisionController) createNewRevision(revision int32) error {
 		UID:        statusConfigMap.UID,
 	}}
 
+	if err := c.syncRevisionResources(ctx, revision, ownerRefs); err != nil {
+		c.cleanupRevision(ctx, revision)
+		return err
+	}
+
+	return nil
+}
+
+// syncRevisionResources fans the per-resource copies for this revision out across a bounded worker pool, stamping
+// each revisioned copy with its content-hash annotation, and returns the first error encountered, if any. Each
+// revisioned copy gets a fresh ObjectMeta carrying only Name/Namespace/OwnerReferences/the hash annotation rather
+// than a DeepCopy of the live source, so Finalizers, Labels and other source annotations never leak onto a
+// revision snapshot and cause cleanupRevision/pruneRevisionHistory deletes to hang in Terminating. It does not
+// clean up on failure; callers are responsible for rolling back whatever was already created.
+func (c RevisionController) syncRevisionResources(ctx context.Context, revision int32, ownerRefs []metav1.OwnerReference) error {
+	tasks := make([]func() error, 0, len(c.configMaps)+len(c.secrets))
 	for _, name := range c.configMaps {
-		obj, _, err := resourceapply.SyncConfigMap(c.kubeClient.CoreV1(), c.eventRecorder, c.targetNamespace, name, c.targetNamespace, nameFor(name, revision), ownerRefs)
-		if err != nil {
+		name := name
+		tasks = append(tasks, func() error {
+			required, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return apierrors.NewNotFound(corev1.Resource("configmaps"), name)
+			}
+			if err != nil {
+				return err
+			}
+			hash, err := contentHash(required.Data)
+			if err != nil {
+				return err
+			}
+			revisioned := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            nameFor(name, revision),
+					Namespace:       c.targetNamespace,
+					OwnerReferences: ownerRefs,
+					Annotations:     map[string]string{revisionContentHashAnnotation: hash},
+				},
+				Data:       required.Data,
+				BinaryData: required.BinaryData,
+			}
+			_, _, err = resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, revisioned)
 			return err
+		})
+	}
+	for _, name := range c.secrets {
+		name := name
+		tasks = append(tasks, func() error {
+			required, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return apierrors.NewNotFound(corev1.Resource("secrets"), name)
+			}
+			if err != nil {
+				return err
+			}
+			hash, err := contentHash(required.Data)
+			if err != nil {
+				return err
+			}
+			revisioned := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            nameFor(name, revision),
+					Namespace:       c.targetNamespace,
+					OwnerReferences: ownerRefs,
+					Annotations:     map[string]string{revisionContentHashAnnotation: hash},
+				},
+				Type: required.Type,
+				Data: required.Data,
+			}
+			_, _, err = resourceapply.ApplySecret(ctx, c.kubeClient.CoreV1(), c.eventRecorder, revisioned)
+			return err
+		})
+	}
+
+	sem := make(chan struct{}, maxConcurrentRevisionSyncs)
+	errCh := make(chan error, len(tasks))
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		task := task
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := task(); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	// Return the first error seen; the rest are dropped. Every goroutine above
+	// only touches its own resource, so there's nothing left to coordinate.
+	for err := range errCh {
+		return err
+	}
+	return nil
+}
+
+// cleanupRevision deletes every revision-suffixed configmap and secret
+// already materialized for revision, including the revision-status
+// configmap, so a partially created revision never lingers as an orphaned
+// "InProgress" snapshot.
+func (c RevisionController) cleanupRevision(ctx context.Context, revision int32) {
+	for _, name := range c.configMaps {
+		revisionedName := nameFor(name, revision)
+		if err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Delete(ctx, revisionedName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			utilruntime.HandleError(fmt.Errorf("failed to clean up configmap/%s after revision %d creation failed: %v", revisionedName, revision, err))
 		}
-		if obj == nil {
-			return apierrors.NewNotFound(corev1.Resource("configmaps"), name)
+	}
+	for _, name := range c.secrets {
+		revisionedName := nameFor(name, revision)
+		if err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Delete(ctx, revisionedName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			utilruntime.HandleError(fmt.Errorf("failed to clean up secret/%s after revision %d creation failed: %v", revisionedName, revision, err))
 		}
 	}
+	statusConfigMapName := nameFor("revision-status", revision)
+	if err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Delete(ctx, statusConfigMapName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		utilruntime.HandleError(fmt.Errorf("failed to clean up configmap/%s after revision %d creation failed: %v", statusConfigMapName, revision, err))
+	}
+}
+
+// pruneRevisionHistory deletes revisioned configmaps/secrets (and the matching revision-status configmap) that fall
+// below LatestAvailableRevision-revisionHistoryLimit, unless a node still references that revision as its
+// CurrentRevision or TargetRevision. It is a no-op when revisionHistoryLimit is unset.
+func (c RevisionController) pruneRevisionHistory(ctx context.Context) error {
+	if c.revisionHistoryLimit <= 0 {
+		return nil
+	}
+
+	_, operatorStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+
+	pruneBelow := operatorStatus.LatestAvailableRevision - c.revisionHistoryLimit
+	if pruneBelow <= 0 {
+		return nil
+	}
+
+	referencedRevisions := map[int32]bool{}
+	for _, nodeStatus := range operatorStatus.NodeStatuses {
+		referencedRevisions[nodeStatus.CurrentRevision] = true
+		referencedRevisions[nodeStatus.TargetRevision] = true
+	}
+
+	trackedConfigMaps := map[string]bool{"revision-status": true}
+	for _, name := range c.configMaps {
+		trackedConfigMaps[name] = true
+	}
+	trackedSecrets := map[string]bool{}
 	for _, name := range c.secrets {
-		obj, _, err := resourceapply.SyncSecret(c.kubeClient.CoreV1(), c.eventRecorder, c.targetNamespace, name, c.targetNamespace, nameFor(name, revision), ownerRefs)
-		if err != nil {
+		trackedSecrets[name] = true
+	}
+
+	configMaps, err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, configMap := range configMaps.Items {
+		name, revision, ok := splitRevisionedName(configMap.Name)
+		if !ok || !trackedConfigMaps[name] || revision >= pruneBelow || referencedRevisions[revision] {
+			continue
+		}
+		if err := c.kubeClient.CoreV1().ConfigMaps(c.targetNamespace).Delete(ctx, configMap.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
 			return err
 		}
-		if obj == nil {
-			return apierrors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+
+	secrets, err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets.Items {
+		name, revision, ok := splitRevisionedName(secret.Name)
+		if !ok || !trackedSecrets[name] || revision >= pruneBelow || referencedRevisions[revision] {
+			continue
+		}
+		if err := c.kubeClient.CoreV1().Secrets(c.targetNamespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (c RevisionController) sync() error {
-	operatorSpec, originalOperatorStatus, resourceVersion, err := c.operatorConfigClient.Get()
+// splitRevisionedName splits a "<name>-<revision>" object name into its base name and revision number.
+func splitRevisionedName(name string) (string, int32, bool) {
+	idx := strings.LastIndex(name, "-")
+	if idx < 0 {
+		return "", 0, false
+	}
+	revision, err := strconv.ParseInt(name[idx+1:], 10, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:idx], int32(revision), true
+}
+
+func (c RevisionController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	operatorSpec, originalOperatorStatus, resourceVersion, err := c.operatorClient.GetOperatorState()
 	if err != nil {
 		return err
 	}
@@ -217,7 +579,7 @@ func (c RevisionController) sync() error {
 		return nil
 	}
 
-	requeue, syncErr := c.createRevisionIfNeeded(operatorSpec, operatorStatus, resourceVersion)
+	requeue, syncErr := c.createRevisionIfNeeded(ctx, operatorSpec, operatorStatus, resourceVersion)
 	if requeue && syncErr == nil {
 		return fmt.Errorf("synthetic requeue request (err: %v)", syncErr)
 	}
@@ -233,58 +595,26 @@ func (c RevisionController) sync() error {
 		cond.Reason = "Error"
 		cond.Message = err.Error()
 	}
-	if _, _, updateError := common.UpdateStatus(c.operatorConfigClient, common.UpdateConditionFn(cond)); updateError != nil {
+	if _, _, updateError := v1helpers.UpdateStatus(c.operatorClient, v1helpers.UpdateConditionFn(cond)); updateError != nil {
 		if err == nil {
 			return updateError
 		}
 	}
 
-	return err
-}
-
-// Run starts the kube-apiserver and blocks until stopCh is closed.
-func (c *RevisionController) Run(workers int, stopCh <-chan struct{}) {
-	defer utilruntime.HandleCrash()
-	defer c.queue.ShutDown()
-
-	glog.Infof("Starting RevisionController")
-	defer glog.Infof("Shutting down RevisionController")
-
-	// doesn't matter what workers say, only start one.
-	go wait.Until(c.runWorker, time.Second, stopCh)
-
-	<-stopCh
-}
-
-func (c *RevisionController) runWorker() {
-	for c.processNextWorkItem() {
+	// Pruning runs as its own pass with its own condition so a pruning failure never blocks forward
+	// progress on new revisions.
+	prunerCond := operatorv1.OperatorCondition{
+		Type:   "RevisionPrunerDegraded",
+		Status: operatorv1.ConditionFalse,
 	}
-}
-
-func (c *RevisionController) processNextWorkItem() bool {
-	dsKey, quit := c.queue.Get()
-	if quit {
-		return false
+	if pruneErr := c.pruneRevisionHistory(ctx); pruneErr != nil {
+		prunerCond.Status = operatorv1.ConditionTrue
+		prunerCond.Reason = "Error"
+		prunerCond.Message = pruneErr.Error()
 	}
-	defer c.queue.Done(dsKey)
-
-	err := c.sync()
-	if err == nil {
-		c.queue.Forget(dsKey)
-		return true
+	if _, _, updateError := v1helpers.UpdateStatus(c.operatorClient, v1helpers.UpdateConditionFn(prunerCond)); updateError != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to update %s condition: %v", prunerCond.Type, updateError))
 	}
 
-	utilruntime.HandleError(fmt.Errorf("%v failed with : %v", dsKey, err))
-	c.queue.AddRateLimited(dsKey)
-
-	return true
-}
-
-// eventHandler queues the operator to check spec and status
-func (c *RevisionController) eventHandler() cache.ResourceEventHandler {
-	return cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(obj interface{}) { c.queue.Add(revisionControllerWorkQueueKey) },
-		UpdateFunc: func(old, new interface{}) { c.queue.Add(revisionControllerWorkQueueKey) },
-		DeleteFunc: func(obj interface{}) { c.queue.Add(revisionControllerWorkQueueKey) },
-	}
+	return err
 }
@@ -0,0 +1,489 @@
+package revision
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+)
+
+// TestUpdateStatusSurvivesConflicts backs up the premise the controller's status updates rely on in
+// place of a retry.RetryOnConflict wrapper of their own: v1helpers.UpdateStatus already retries on conflict internally,
+// re-reading operator state on every attempt, so a status update still lands even if earlier
+// attempts lose the race to another writer.
+func TestUpdateStatusSurvivesConflicts(t *testing.T) {
+	status := &operatorv1.StaticPodOperatorStatus{}
+	attempts := 0
+	const conflictsBeforeSuccess = 2
+	operatorClient := v1helpers.NewFakeStaticPodOperatorClient(
+		&operatorv1.StaticPodOperatorSpec{}, status,
+		func(rv string, status *operatorv1.StaticPodOperatorStatus) error {
+			attempts++
+			if attempts <= conflictsBeforeSuccess {
+				return apierrors.NewConflict(schema.GroupResource{Resource: "teststatuses"}, "test", fmt.Errorf("conflicting writer"))
+			}
+			return nil
+		},
+		nil,
+	)
+
+	cond := operatorv1.OperatorCondition{Type: "Foo", Status: operatorv1.ConditionTrue}
+	_, updated, err := v1helpers.UpdateStatus(operatorClient, v1helpers.UpdateConditionFn(cond))
+	if err != nil {
+		t.Fatalf("expected UpdateStatus to survive transient conflicts, got err=%v", err)
+	}
+	if !updated {
+		t.Fatal("expected status to be reported as updated")
+	}
+	if attempts != conflictsBeforeSuccess+1 {
+		t.Fatalf("expected %d attempts (%d conflicts + 1 success), got %d", conflictsBeforeSuccess+1, conflictsBeforeSuccess, attempts)
+	}
+}
+
+// TestCreateNewRevisionRollsBackOnPartialFailure verifies that when one of a
+// revision's tracked resources fails to sync, everything already created for
+// that revision - including the revision-status configmap - is torn down
+// rather than left behind as an orphaned, half-materialized snapshot.
+func TestCreateNewRevisionRollsBackOnPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	const revision = int32(1)
+
+	kubeClient := kubefake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "ns"},
+		Data:       map[string]string{"foo": "bar"},
+	})
+	kubeClient.PrependReactor("get", "secrets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(corev1.Resource("secrets"), "secret")
+	})
+
+	c := RevisionController{
+		targetNamespace: "ns",
+		configMaps:      []string{"config"},
+		secrets:         []string{"secret"},
+		kubeClient:      kubeClient,
+		eventRecorder:   events.NewInMemoryRecorder("test"),
+	}
+
+	if err := c.createNewRevision(ctx, revision); err == nil {
+		t.Fatal("expected createNewRevision to fail when a tracked secret is missing")
+	}
+
+	if _, err := kubeClient.CoreV1().ConfigMaps("ns").Get(ctx, nameFor("config", revision), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected revisioned configmap/%s to be rolled back, got err=%v", nameFor("config", revision), err)
+	}
+	if _, err := kubeClient.CoreV1().ConfigMaps("ns").Get(ctx, nameFor("revision-status", revision), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected revision-status configmap to be rolled back, got err=%v", err)
+	}
+}
+
+// TestCleanupRevisionDeletesAllRevisionedResources verifies cleanupRevision removes every
+// revision-suffixed configmap and secret it tracks, plus the revision-status configmap,
+// and tolerates any of them already being absent.
+func TestCleanupRevisionDeletesAllRevisionedResources(t *testing.T) {
+	ctx := context.Background()
+	const revision = int32(2)
+
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: nameFor("config", revision), Namespace: "ns"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: nameFor("revision-status", revision), Namespace: "ns"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: nameFor("secret", revision), Namespace: "ns"}},
+	)
+
+	c := RevisionController{
+		targetNamespace: "ns",
+		configMaps:      []string{"config"},
+		secrets:         []string{"secret", "missing-secret"},
+		kubeClient:      kubeClient,
+	}
+
+	c.cleanupRevision(ctx, revision)
+
+	if _, err := kubeClient.CoreV1().ConfigMaps("ns").Get(ctx, nameFor("config", revision), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected configmap/%s to be deleted, got err=%v", nameFor("config", revision), err)
+	}
+	if _, err := kubeClient.CoreV1().ConfigMaps("ns").Get(ctx, nameFor("revision-status", revision), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected revision-status configmap to be deleted, got err=%v", err)
+	}
+	if _, err := kubeClient.CoreV1().Secrets("ns").Get(ctx, nameFor("secret", revision), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected secret/%s to be deleted, got err=%v", nameFor("secret", revision), err)
+	}
+}
+
+// TestPruneRevisionHistoryRespectsNodeStatusExemption verifies that pruneRevisionHistory deletes
+// revisioned configmaps below the retention window while leaving alone any revision still
+// referenced by a node's CurrentRevision or TargetRevision, even though that revision also falls
+// below the window.
+func TestPruneRevisionHistoryRespectsNodeStatusExemption(t *testing.T) {
+	ctx := context.Background()
+
+	status := &operatorv1.StaticPodOperatorStatus{
+		OperatorStatus: operatorv1.OperatorStatus{
+			LatestAvailableRevision: 5,
+		},
+		NodeStatuses: []operatorv1.NodeStatus{
+			{NodeName: "node-1", CurrentRevision: 2, TargetRevision: 2},
+		},
+	}
+	operatorClient := v1helpers.NewFakeStaticPodOperatorClient(&operatorv1.StaticPodOperatorSpec{}, status, nil, nil)
+
+	kubeClient := kubefake.NewSimpleClientset(
+		configMapAt("config", 1, "ns"),
+		configMapAt("config", 2, "ns"),
+		configMapAt("config", 3, "ns"),
+		configMapAt("revision-status", 1, "ns"),
+		configMapAt("revision-status", 2, "ns"),
+	)
+
+	c := RevisionController{
+		targetNamespace:      "ns",
+		configMaps:           []string{"config"},
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		revisionHistoryLimit: 2, // pruneBelow = LatestAvailableRevision(5) - 2 = 3
+	}
+
+	if err := c.pruneRevisionHistory(ctx); err != nil {
+		t.Fatalf("pruneRevisionHistory: %v", err)
+	}
+
+	assertConfigMapDeleted(t, kubeClient, "ns", nameFor("config", 1))
+	assertConfigMapDeleted(t, kubeClient, "ns", nameFor("revision-status", 1))
+	assertConfigMapExists(t, kubeClient, "ns", nameFor("config", 2))
+	assertConfigMapExists(t, kubeClient, "ns", nameFor("revision-status", 2))
+	assertConfigMapExists(t, kubeClient, "ns", nameFor("config", 3))
+}
+
+func configMapAt(name string, revision int32, namespace string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: nameFor(name, revision), Namespace: namespace}}
+}
+
+func assertConfigMapDeleted(t *testing.T, kubeClient *kubefake.Clientset, namespace, name string) {
+	t.Helper()
+	if _, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected configmap/%s to be pruned, got err=%v", name, err)
+	}
+}
+
+func assertConfigMapExists(t *testing.T, kubeClient *kubefake.Clientset, namespace, name string) {
+	t.Helper()
+	if _, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected configmap/%s to be retained, got err=%v", name, err)
+	}
+}
+
+// TestConfigMapContentUnchanged covers the content-hash comparison path, including its
+// DeepEqual migration fallback for existing objects that predate the content-hash annotation.
+func TestConfigMapContentUnchanged(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("hash match short-circuits regardless of stale Data", func(t *testing.T) {
+		required := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm"}, Data: map[string]string{"a": "new"}}
+		hash, err := contentHash(required.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: "ns", Annotations: map[string]string{revisionContentHashAnnotation: hash}},
+			Data:       map[string]string{"a": "stale"},
+		}
+		kubeClient := kubefake.NewSimpleClientset(existing)
+		c := RevisionController{targetNamespace: "ns", kubeClient: kubeClient}
+
+		if !c.configMapContentUnchanged(ctx, existing, required) {
+			t.Error("expected matching hash to report unchanged")
+		}
+	})
+
+	t.Run("hash mismatch reports changed", func(t *testing.T) {
+		existing := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: "ns", Annotations: map[string]string{revisionContentHashAnnotation: "deadbeef"}},
+			Data:       map[string]string{"a": "b"},
+		}
+		required := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm"}, Data: map[string]string{"a": "c"}}
+		kubeClient := kubefake.NewSimpleClientset(existing)
+		c := RevisionController{targetNamespace: "ns", kubeClient: kubeClient}
+
+		if c.configMapContentUnchanged(ctx, existing, required) {
+			t.Error("expected hash mismatch to report changed")
+		}
+	})
+
+	t.Run("missing annotation falls back to DeepEqual and backfills", func(t *testing.T) {
+		data := map[string]string{"a": "b"}
+		existing := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: "ns"}, Data: data}
+		required := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm"}, Data: data}
+		kubeClient := kubefake.NewSimpleClientset(existing)
+		c := RevisionController{targetNamespace: "ns", kubeClient: kubeClient}
+
+		if !c.configMapContentUnchanged(ctx, existing, required) {
+			t.Fatal("expected DeepEqual fallback to report unchanged for identical data")
+		}
+
+		wantHash, err := contentHash(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := kubeClient.CoreV1().ConfigMaps("ns").Get(ctx, "cm", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := updated.Annotations[revisionContentHashAnnotation]; got != wantHash {
+			t.Errorf("expected backfilled annotation %q, got %q", wantHash, got)
+		}
+	})
+
+	t.Run("missing annotation and changed data reports changed without backfilling", func(t *testing.T) {
+		existing := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: "ns"}, Data: map[string]string{"a": "b"}}
+		required := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm"}, Data: map[string]string{"a": "c"}}
+		kubeClient := kubefake.NewSimpleClientset(existing)
+		c := RevisionController{targetNamespace: "ns", kubeClient: kubeClient}
+
+		if c.configMapContentUnchanged(ctx, existing, required) {
+			t.Fatal("expected DeepEqual fallback to report changed for differing data")
+		}
+
+		updated, err := kubeClient.CoreV1().ConfigMaps("ns").Get(ctx, "cm", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := updated.Annotations[revisionContentHashAnnotation]; ok {
+			t.Error("did not expect a backfilled annotation when content actually changed")
+		}
+	})
+}
+
+// TestSecretContentUnchanged spot-checks the secret analog of configMapContentUnchanged: the hash
+// path and the missing-annotation DeepEqual-and-backfill path.
+func TestSecretContentUnchanged(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("hash match short-circuits", func(t *testing.T) {
+		required := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sec"}, Data: map[string][]byte{"a": []byte("new")}}
+		hash, err := contentHash(required.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sec", Namespace: "ns", Annotations: map[string]string{revisionContentHashAnnotation: hash}},
+			Data:       map[string][]byte{"a": []byte("stale")},
+		}
+		kubeClient := kubefake.NewSimpleClientset(existing)
+		c := RevisionController{targetNamespace: "ns", kubeClient: kubeClient}
+
+		if !c.secretContentUnchanged(ctx, existing, required) {
+			t.Error("expected matching hash to report unchanged")
+		}
+	})
+
+	t.Run("missing annotation falls back to DeepEqual and backfills", func(t *testing.T) {
+		data := map[string][]byte{"a": []byte("b")}
+		existing := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sec", Namespace: "ns"}, Data: data}
+		required := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sec"}, Data: data}
+		kubeClient := kubefake.NewSimpleClientset(existing)
+		c := RevisionController{targetNamespace: "ns", kubeClient: kubeClient}
+
+		if !c.secretContentUnchanged(ctx, existing, required) {
+			t.Fatal("expected DeepEqual fallback to report unchanged for identical data")
+		}
+
+		wantHash, err := contentHash(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := kubeClient.CoreV1().Secrets("ns").Get(ctx, "sec", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := updated.Annotations[revisionContentHashAnnotation]; got != wantHash {
+			t.Errorf("expected backfilled annotation %q, got %q", wantHash, got)
+		}
+	})
+}
+
+// TestContentHashStableAcrossMapKeyOrder guards against contentHash silently regressing if its
+// reliance on encoding/json's automatic map-key sorting ever breaks: two maps with the same
+// key/value pairs in different insertion order must hash identically.
+func TestContentHashStableAcrossMapKeyOrder(t *testing.T) {
+	a := map[string]string{"x": "1", "y": "2"}
+	b := map[string]string{"y": "2", "x": "1"}
+
+	hashA, err := contentHash(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashB, err := contentHash(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashA != hashB {
+		t.Errorf("expected contentHash to be order-independent, got %q vs %q", hashA, hashB)
+	}
+}
+
+// TestRunPreconditionsShortCircuitsOnFirstVeto verifies preconditions run in order and evaluation
+// stops at the first one that vetoes the rollout, without running any preconditions after it.
+func TestRunPreconditionsShortCircuitsOnFirstVeto(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := kubefake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "ns"}})
+
+	var calls []int
+	c := RevisionController{
+		targetNamespace: "ns",
+		configMaps:      []string{"config"},
+		kubeClient:      kubeClient,
+		preconditions: []RevisionPrecondition{
+			func(ctx context.Context, configMaps []*corev1.ConfigMap, secrets []*corev1.Secret) (bool, string, error) {
+				calls = append(calls, 1)
+				return false, "waiting for cert rotation", nil
+			},
+			func(ctx context.Context, configMaps []*corev1.ConfigMap, secrets []*corev1.Secret) (bool, string, error) {
+				calls = append(calls, 2)
+				return true, "", nil
+			},
+		},
+	}
+
+	proceed, reason, err := c.runPreconditions(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proceed {
+		t.Fatal("expected the first precondition's veto to block proceeding")
+	}
+	if reason != "waiting for cert rotation" {
+		t.Errorf("expected the vetoing precondition's reason to be returned, got %q", reason)
+	}
+	if got := []int{1}; len(calls) != len(got) || calls[0] != got[0] {
+		t.Errorf("expected evaluation to stop after the first veto, got calls=%v", calls)
+	}
+}
+
+// TestRunPreconditionsSurfacesError verifies an error from a precondition is returned directly,
+// rather than being swallowed or treated as a veto with no error.
+func TestRunPreconditionsSurfacesError(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := kubefake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "ns"}})
+
+	wantErr := fmt.Errorf("precondition check failed")
+	c := RevisionController{
+		targetNamespace: "ns",
+		configMaps:      []string{"config"},
+		kubeClient:      kubeClient,
+		preconditions: []RevisionPrecondition{
+			func(ctx context.Context, configMaps []*corev1.ConfigMap, secrets []*corev1.Secret) (bool, string, error) {
+				return false, "", wantErr
+			},
+		},
+	}
+
+	proceed, _, err := c.runPreconditions(ctx)
+	if err != wantErr {
+		t.Fatalf("expected precondition error to be surfaced, got %v", err)
+	}
+	if proceed {
+		t.Fatal("expected proceed=false when a precondition errors")
+	}
+}
+
+// TestCreateRevisionIfNeededDefersOnPreconditionVeto verifies that a vetoing precondition defers
+// the rollout instead of bumping the revision: it requeues, emits a RevisionTriggerDeferred event,
+// sets RevisionControllerProgressing=False/Deferred, and leaves LatestAvailableRevision untouched.
+func TestCreateRevisionIfNeededDefersOnPreconditionVeto(t *testing.T) {
+	ctx := context.Background()
+
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "ns"}, Data: map[string]string{"a": "new"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: nameFor("config", 1), Namespace: "ns"}, Data: map[string]string{"a": "old"}},
+	)
+	status := &operatorv1.StaticPodOperatorStatus{OperatorStatus: operatorv1.OperatorStatus{LatestAvailableRevision: 1}}
+	operatorClient := v1helpers.NewFakeStaticPodOperatorClient(&operatorv1.StaticPodOperatorSpec{}, status, nil, nil)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := RevisionController{
+		targetNamespace: "ns",
+		configMaps:      []string{"config"},
+		operatorClient:  operatorClient,
+		kubeClient:      kubeClient,
+		eventRecorder:   recorder,
+		preconditions: []RevisionPrecondition{
+			func(ctx context.Context, configMaps []*corev1.ConfigMap, secrets []*corev1.Secret) (bool, string, error) {
+				return false, "waiting for cert rotation", nil
+			},
+		},
+	}
+
+	requeue, err := c.createRevisionIfNeeded(ctx, &operatorv1.OperatorSpec{}, status, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !requeue {
+		t.Fatal("expected a deferred revision to request a requeue")
+	}
+
+	_, finalStatus, _, err := operatorClient.GetOperatorState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finalStatus.LatestAvailableRevision != 1 {
+		t.Errorf("expected LatestAvailableRevision to stay at 1, got %d", finalStatus.LatestAvailableRevision)
+	}
+
+	var progressing *operatorv1.OperatorCondition
+	for i := range finalStatus.Conditions {
+		if finalStatus.Conditions[i].Type == "RevisionControllerProgressing" {
+			progressing = &finalStatus.Conditions[i]
+		}
+	}
+	if progressing == nil {
+		t.Fatal("expected a RevisionControllerProgressing condition to be set")
+	}
+	if progressing.Status != operatorv1.ConditionFalse || progressing.Reason != "Deferred" {
+		t.Errorf("expected RevisionControllerProgressing=False/Deferred, got %+v", progressing)
+	}
+
+	foundEvent := false
+	for _, event := range recorder.Events() {
+		if event.Reason == "RevisionTriggerDeferred" {
+			foundEvent = true
+		}
+	}
+	if !foundEvent {
+		t.Error("expected a RevisionTriggerDeferred event to be emitted")
+	}
+}
+
+func TestSplitRevisionedName(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantBase     string
+		wantRevision int32
+		wantOK       bool
+	}{
+		{name: "valid", input: "config-3", wantBase: "config", wantRevision: 3, wantOK: true},
+		{name: "hyphenated base", input: "kube-apiserver-pod-12", wantBase: "kube-apiserver-pod", wantRevision: 12, wantOK: true},
+		{name: "no hyphen", input: "config", wantOK: false},
+		{name: "non-numeric suffix", input: "config-latest", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, revision, ok := splitRevisionedName(tt.input)
+			if ok != tt.wantOK || (ok && (base != tt.wantBase || revision != tt.wantRevision)) {
+				t.Errorf("splitRevisionedName(%q) = (%q, %d, %v), want (%q, %d, %v)",
+					tt.input, base, revision, ok, tt.wantBase, tt.wantRevision, tt.wantOK)
+			}
+		})
+	}
+}